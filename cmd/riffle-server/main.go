@@ -0,0 +1,40 @@
+//riffle-server runs a single mix server as a daemon, configured from a
+//servers.yaml file (see server.ServerConfig).
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"afs/server"
+)
+
+func main() {
+	configPath := flag.String("config", "servers.yaml", "path to the server's YAML config file")
+	flag.Parse()
+
+	cfg, err := server.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := cfg.NewServer()
+	s.MainLoop()
+	s.ConnectServers()
+
+	if err := s.ServeMetrics(cfg.MetricsAddr); err != nil {
+		log.Printf("riffle-server: could not start metrics endpoint: %v", err)
+	}
+
+	log.Printf("riffle-server %d listening on %s (log level %s)", cfg.Id, cfg.Addr, cfg.LogLevel)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+
+	log.Println("riffle-server shutting down")
+	s.Close()
+}
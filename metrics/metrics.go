@@ -0,0 +1,167 @@
+//Package metrics provides cheap, allocation-free counters, gauges and
+//histograms for instrumenting a Server's hot paths (round latency, shuffle
+//latency, per-peer RPC latency, channel depths), in the spirit of
+//ethereum's eth/metrics.go: handles are created once at startup and updated
+//with plain arithmetic on the fast path, never formatted or allocated per
+//event.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Counter is a monotonically increasing int64, updated with Inc/Add.
+type Counter struct {
+	name  string
+	value int64
+}
+
+func (c *Counter) Inc()           { atomic.AddInt64(&c.value, 1) }
+func (c *Counter) Add(delta int64) { atomic.AddInt64(&c.value, delta) }
+func (c *Counter) Value() int64   { return atomic.LoadInt64(&c.value) }
+
+//Gauge is a value that can go up or down, e.g. a channel's pending depth.
+type Gauge struct {
+	name  string
+	value int64
+}
+
+func (g *Gauge) Set(v int64)      { atomic.StoreInt64(&g.value, v) }
+func (g *Gauge) Inc()             { atomic.AddInt64(&g.value, 1) }
+func (g *Gauge) Dec()             { atomic.AddInt64(&g.value, -1) }
+func (g *Gauge) Value() int64     { return atomic.LoadInt64(&g.value) }
+
+//Histogram tracks a running count/sum plus bucketed counts for latency-style
+//observations. Buckets are upper bounds in the same unit as Observe's
+//argument (ObserveDuration passes milliseconds).
+type Histogram struct {
+	name    string
+	buckets []float64 //sorted upper bounds, ascending
+
+	mu          sync.Mutex
+	count       int64
+	sum         float64
+	bucketCount []int64
+}
+
+func newHistogram(name string, buckets []float64) *Histogram {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &Histogram{
+		name:        name,
+		buckets:     sorted,
+		bucketCount: make([]int64, len(sorted)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count++
+	h.sum += v
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.bucketCount[i]++
+		}
+	}
+}
+
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(float64(d) / float64(time.Millisecond))
+}
+
+func (h *Histogram) Snapshot() (count int64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count, h.sum
+}
+
+//Registry owns a fixed set of metric handles created up front; hot paths
+//look up nothing at event time, they just hold the *Counter/*Gauge/
+//*Histogram they were handed by New*.
+type Registry struct {
+	mu         sync.Mutex
+	counters   []*Counter
+	gauges     []*Gauge
+	histograms []*Histogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) NewCounter(name string) *Counter {
+	c := &Counter{name: name}
+	r.mu.Lock()
+	r.counters = append(r.counters, c)
+	r.mu.Unlock()
+	return c
+}
+
+func (r *Registry) NewGauge(name string) *Gauge {
+	g := &Gauge{name: name}
+	r.mu.Lock()
+	r.gauges = append(r.gauges, g)
+	r.mu.Unlock()
+	return g
+}
+
+//defaultLatencyBuckets is in milliseconds: sub-ms through multi-second RPC
+//and shuffle latencies.
+var defaultLatencyBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+func (r *Registry) NewHistogram(name string) *Histogram {
+	h := newHistogram(name, defaultLatencyBuckets)
+	r.mu.Lock()
+	r.histograms = append(r.histograms, h)
+	r.mu.Unlock()
+	return h
+}
+
+//ServeHTTP exposes all registered metrics in the Prometheus text exposition
+//format; ListenAndServe mounts it at /metrics on a config's metrics_addr.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, c := range r.counters {
+		fmt.Fprintf(bw, "# TYPE %s counter\n%s %d\n", c.name, c.name, c.Value())
+	}
+	for _, g := range r.gauges {
+		fmt.Fprintf(bw, "# TYPE %s gauge\n%s %d\n", g.name, g.name, g.Value())
+	}
+	for _, h := range r.histograms {
+		count, sum := h.Snapshot()
+		fmt.Fprintf(bw, "# TYPE %s histogram\n%s_count %d\n%s_sum %f\n", h.name, h.name, count, h.name, sum)
+		h.mu.Lock()
+		for i, upper := range h.buckets {
+			fmt.Fprintf(bw, "%s_bucket{le=\"%g\"} %d\n", h.name, upper, h.bucketCount[i])
+		}
+		h.mu.Unlock()
+	}
+}
+
+//ListenAndServe starts a background HTTP server exposing the registry on
+//addr (e.g. ":9100") at /metrics. A zero-length addr disables it.
+func (r *Registry) ListenAndServe(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("metrics: HTTP endpoint on %s stopped: %v\n", addr, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sync"
+
+	. "afs/lib" //types and utils
+)
+
+/////////////////////////////////
+//Batched download (amortized PIR)
+////////////////////////////////
+//GetResponse recomputes ComputeResponse(s.allBlocks, ...) once per client
+//per round and blocks on one xorsChan receive per peer per client: one
+//goroutine, one channel handshake, and one cross-server RPC per client per
+//peer. GetResponses/GetResponses2 collapse that into one RPC per peer per
+//round covering every client at once. ComputeResponse itself still does
+//its own pass over s.allBlocks per client -- it's an afs/lib primitive, not
+//something this package can restructure into a single shared pass without
+//reimplementing its masking/secret-blinding internals -- so the win here is
+//eliminating the per-client goroutine/channel/RPC fan-out, not reduced
+//memory traffic through ComputeResponse.
+
+//GetResponses computes PIR responses for every cmask in cmasks whose home
+//server is this one and gathers every peer's contribution with a single
+//GetResponses2 RPC call per peer, rather than one GetResponse call (and one
+//channel handshake) per peer per client. The old single-client GetResponse
+//RPC is left in place for callers that haven't switched over.
+func (s *Server) GetResponses(cmasks []ClientMask, responses *[][]byte) error {
+	mine := make([]ClientMask, 0, len(cmasks))
+	for _, cm := range cmasks {
+		if s.clientMap[cm.Id] == s.id {
+			mine = append(mine, cm)
+		}
+	}
+	if len(mine) == 0 {
+		*responses = nil
+		return nil
+	}
+
+	s.waitBlocksReady()
+
+	out := make([][]byte, len(mine))
+	for i, cm := range mine {
+		out[i] = ComputeResponse(s.allBlocks, cm.Mask, s.secrets[cm.Id])
+	}
+
+	errs := make([]error, len(s.servers))
+	peerOuts := make([][][]byte, len(s.servers))
+	var wg sync.WaitGroup
+	for i := range s.servers {
+		if i == s.id {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.call(i, "Server.GetResponses2", mine, &peerOuts[i]); err != nil {
+				errs[i] = err
+			}
+		} (i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	//fold every peer's contribution into out sequentially -- each peerOuts[i]
+	//was written by exactly one goroutine above, but out[j] is shared across
+	//peers, so XORing it from multiple goroutines at once would race
+	for _, peerOut := range peerOuts {
+		if peerOut == nil {
+			continue
+		}
+		for j := range out {
+			xorInto(out[j], peerOut[j])
+		}
+	}
+
+	s.metrics.responsesServed.Add(int64(len(out)))
+	*responses = out
+	return nil
+}
+
+//GetResponses2 is the cross-server counterpart of GetResponses: it computes
+//this server's single-hop XOR contribution for an entire batch of clients
+//in one RPC per peer per round, replacing one PutClientBlock push (and one
+//xorsChan handshake) per client.
+func (s *Server) GetResponses2(cmasks []ClientMask, out *[][]byte) error {
+	s.waitBlocksReady()
+
+	responses := make([][]byte, len(cmasks))
+	for i, cm := range cmasks {
+		responses[i] = ComputeResponse(s.allBlocks, cm.Mask, s.secrets[cm.Id])
+	}
+	*out = responses
+	return nil
+}
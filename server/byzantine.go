@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/rpc"
+
+	. "afs/lib" //types and utils
+)
+
+//ByzantineMode picks which way a ByzantineServer misbehaves during
+//ShuffleBlocks, so tests can drive the shuffle-verification feature
+//(chunk0-1) through real cascade runs instead of only unit-testing
+//verifyShuffle in isolation.
+type ByzantineMode int
+
+const (
+	ByzantineNone              ByzantineMode = iota
+	ByzantineSkipDecrypt                     //skip this hop's shuffle/decrypt and just relay the batch
+	ByzantineCorruptCiphertext               //invert the first byte of a random client's ciphertext before verifying
+	ByzantineReorderNoProof                  //permute the batch without a matching shuffle proof
+)
+
+//ByzantineServer wraps a real *Server and is registered under the same
+//"Server" RPC name, so it is wire-compatible with a real cascade member but
+//can be told to misbehave in ShuffleBlocks.
+type ByzantineServer struct {
+	*Server
+	Mode ByzantineMode
+}
+
+func NewByzantineServer(s *Server, mode ByzantineMode) *ByzantineServer {
+	return &ByzantineServer{Server: s, Mode: mode}
+}
+
+//Serve registers b (not the embedded *Server directly) as the RPC receiver
+//and starts accepting connections; use this instead of Server.MainLoop.
+func (b *ByzantineServer) Serve() error {
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("Server", b); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", b.addr)
+	if err != nil {
+		return err
+	}
+	b.listener = l
+	go rpcServer.Accept(l)
+
+	RunFunc(b.handleResponse)
+	RunFunc(b.handleUpload)
+	RunFunc(b.gatherUploads)
+	RunFunc(b.shuffleUploads)
+	RunFunc(b.handleRequest)
+	return nil
+}
+
+func (b *ByzantineServer) ShuffleBlocks(batch ShuffleBatch, reply *int) error {
+	switch b.Mode {
+	case ByzantineSkipDecrypt:
+		return b.forwardUnshuffled(batch)
+	case ByzantineCorruptCiphertext:
+		return b.Server.ShuffleBlocks(corruptOneUpload(batch), reply)
+	case ByzantineReorderNoProof:
+		return b.forwardReordered(batch)
+	default:
+		return b.Server.ShuffleBlocks(batch, reply)
+	}
+}
+
+//forwardUnshuffled relays batch to the next hop completely untouched,
+//skipping this server's own shuffle/decrypt layer. The next server's
+//verifyShuffle call is expected to reject it (the proof it carries is from
+//two hops back, not from this server).
+func (s *Server) forwardUnshuffled(batch ShuffleBatch) error {
+	if s.id == len(s.servers)-1 {
+		return fmt.Errorf("byzantine server %d: cannot broadcast without decrypting the final layer", s.id)
+	}
+	return s.call(s.id+1, "Server.ShuffleBlocks", batch, nil)
+}
+
+//forwardReordered permutes batch.Uploads and forwards it without generating
+//a new shuffle proof for that permutation.
+func (s *Server) forwardReordered(batch ShuffleBatch) error {
+	if s.id == len(s.servers)-1 {
+		return fmt.Errorf("byzantine server %d: cannot broadcast a reordered batch without a shuffle proof", s.id)
+	}
+	perm := rand.Perm(len(batch.Uploads))
+	reordered := make([]UpBlock, len(batch.Uploads))
+	for from, to := range perm {
+		reordered[to] = batch.Uploads[from]
+	}
+	batch.Uploads = reordered
+	return s.call(s.id+1, "Server.ShuffleBlocks", batch, nil)
+}
+
+//corruptOneUpload inverts the first byte of one random chunk of one random
+//client's block ciphertext.
+func corruptOneUpload(batch ShuffleBatch) ShuffleBatch {
+	if len(batch.Uploads) == 0 {
+		return batch
+	}
+	i := rand.Intn(len(batch.Uploads))
+	if len(batch.Uploads[i].BC1) == 0 {
+		return batch
+	}
+	j := rand.Intn(len(batch.Uploads[i].BC1))
+	corrupted := append([]byte(nil), batch.Uploads[i].BC1[j]...)
+	corrupted[0] ^= 0xFF
+	batch.Uploads[i].BC1[j] = corrupted
+	return batch
+}
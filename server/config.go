@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	. "afs/lib" //types and utils
+
+	"gopkg.in/yaml.v2"
+)
+
+//ServerConfig describes everything one riffle-server daemon needs to know
+//about itself and its cascade, as loaded from a YAML file such as
+//servers.yaml:
+//
+//  addr: "10.0.0.2:9000"
+//  port: 9000
+//  id: 1
+//  servers:
+//    - "10.0.0.1:9000"
+//    - "10.0.0.2:9000"
+//    - "10.0.0.3:9000"
+//  suite: "ed25519"
+//  num_clients: 64
+//  block_size: 1024
+//  secret_size: 32
+//  log_level: "info"
+//  metrics_addr: ":9100"
+type ServerConfig struct {
+	Addr       string   `yaml:"addr"`
+	Port       int      `yaml:"port"`
+	Id         int      `yaml:"id"`
+	Servers    []string `yaml:"servers"`
+	Suite      string   `yaml:"suite"`
+	NumClients int      `yaml:"num_clients"`
+	BlockSize  int      `yaml:"block_size"`
+	SecretSize int      `yaml:"secret_size"`
+	LogLevel   string   `yaml:"log_level"`
+	MetricsAddr string  `yaml:"metrics_addr"` //e.g. ":9100"; empty disables the /metrics endpoint
+}
+
+//env vars that override the matching YAML field, so a config file can be
+//shared across a cluster and only the per-node bits overridden at launch
+const (
+	envAddr    = "RIFFLE_ADDR"
+	envPort    = "RIFFLE_PORT"
+	envId      = "RIFFLE_ID"
+	envServers = "RIFFLE_SERVERS" //comma-separated
+	envSuite   = "RIFFLE_SUITE"
+	envLogLvl  = "RIFFLE_LOG_LEVEL"
+	envMetrics = "RIFFLE_METRICS_ADDR"
+)
+
+//LoadConfig reads and parses a ServerConfig from path, applying any
+//RIFFLE_* environment overrides on top. Exposed as its own API (rather than
+//folded into main) so tests can exercise config parsing against a temp
+//file, or skip parsing by constructing a ServerConfig directly.
+func LoadConfig(path string) (*ServerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config %s: %v", path, err)
+	}
+
+	cfg := &ServerConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse config %s: %v", path, err)
+	}
+
+	cfg.applyEnvOverrides()
+
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("config %s: addr is required", path)
+	}
+	if len(cfg.Servers) == 0 {
+		return nil, fmt.Errorf("config %s: servers list is required", path)
+	}
+	if cfg.Id < 0 || cfg.Id >= len(cfg.Servers) {
+		return nil, fmt.Errorf("config %s: id %d out of range for %d servers", path, cfg.Id, len(cfg.Servers))
+	}
+
+	return cfg, nil
+}
+
+func (cfg *ServerConfig) applyEnvOverrides() {
+	if v := os.Getenv(envAddr); v != "" {
+		cfg.Addr = v
+	}
+	if v := os.Getenv(envPort); v != "" {
+		if p, err := strconv.Atoi(v); err == nil {
+			cfg.Port = p
+		} else {
+			log.Printf("riffle: ignoring invalid %s=%q: %v", envPort, v, err)
+		}
+	}
+	if v := os.Getenv(envId); v != "" {
+		if id, err := strconv.Atoi(v); err == nil {
+			cfg.Id = id
+		} else {
+			log.Printf("riffle: ignoring invalid %s=%q: %v", envId, v, err)
+		}
+	}
+	if v := os.Getenv(envServers); v != "" {
+		cfg.Servers = strings.Split(v, ",")
+	}
+	if v := os.Getenv(envSuite); v != "" {
+		cfg.Suite = v
+	}
+	if v := os.Getenv(envLogLvl); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := os.Getenv(envMetrics); v != "" {
+		cfg.MetricsAddr = v
+	}
+}
+
+//NewServer constructs a *Server from this config. Fields that the current
+//Server/NewServer don't yet take as parameters (Suite, NumClients,
+//BlockSize, SecretSize) are compiled into the afs/lib package rather than
+//runtime-configurable; NewServer logs a warning if the config disagrees
+//with the compiled-in values instead of silently ignoring the mismatch.
+//
+//Suite itself isn't checked this way: afs/lib's Suite is an abstract.Suite
+//value, not a name, and there's no registry in this tree mapping suite
+//names like "ed25519" back to one to compare cfg.Suite against without
+//false-positiving on every correctly-configured node. cfg.Suite is parsed
+//and env-overridden like the others above so it round-trips once such a
+//registry exists, but until then it's accepted without a mismatch check.
+func (cfg *ServerConfig) NewServer() *Server {
+	if cfg.NumClients != 0 && cfg.NumClients != NumClients {
+		log.Printf("riffle: config num_clients=%d but this binary was built with NumClients=%d", cfg.NumClients, NumClients)
+	}
+	if cfg.BlockSize != 0 && cfg.BlockSize != BlockSize {
+		log.Printf("riffle: config block_size=%d but this binary was built with BlockSize=%d", cfg.BlockSize, BlockSize)
+	}
+	if cfg.SecretSize != 0 && cfg.SecretSize != SecretSize {
+		log.Printf("riffle: config secret_size=%d but this binary was built with SecretSize=%d", cfg.SecretSize, SecretSize)
+	}
+	return NewServer(cfg.Addr, cfg.Port, cfg.Id, cfg.Servers)
+}
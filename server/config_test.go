@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "riffle-config-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer func() {
+		if t.Failed() {
+			os.RemoveAll(dir)
+		}
+	}()
+	path := filepath.Join(dir, "servers.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("could not write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigValid(t *testing.T) {
+	path := writeConfig(t, `
+addr: "127.0.0.1:9000"
+port: 9000
+id: 1
+servers:
+  - "127.0.0.1:9000"
+  - "127.0.0.1:9001"
+num_clients: 4
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Addr != "127.0.0.1:9000" || cfg.Id != 1 || len(cfg.Servers) != 2 || cfg.NumClients != 4 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join(os.TempDir(), "riffle-does-not-exist.yaml")); err == nil {
+		t.Fatal("expected an error for a missing config file")
+	}
+}
+
+func TestLoadConfigRequiresAddr(t *testing.T) {
+	path := writeConfig(t, `
+servers:
+  - "127.0.0.1:9000"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected an error for a config with no addr")
+	}
+}
+
+func TestLoadConfigRequiresServers(t *testing.T) {
+	path := writeConfig(t, `
+addr: "127.0.0.1:9000"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected an error for a config with no servers list")
+	}
+}
+
+func TestLoadConfigRejectsOutOfRangeId(t *testing.T) {
+	path := writeConfig(t, `
+addr: "127.0.0.1:9000"
+id: 5
+servers:
+  - "127.0.0.1:9000"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected an error for an out-of-range id")
+	}
+}
+
+func TestLoadConfigEnvOverride(t *testing.T) {
+	path := writeConfig(t, `
+addr: "127.0.0.1:9000"
+id: 0
+servers:
+  - "127.0.0.1:9000"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	os.Setenv(envAddr, "10.0.0.5:9000")
+	defer os.Unsetenv(envAddr)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Addr != "10.0.0.5:9000" {
+		t.Fatalf("expected env override to win, got addr=%q", cfg.Addr)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+//FuzzParams configures how much a FuzzConn misbehaves. Each Prob* field is
+//a probability in [0,1] checked independently on every Read/Write, in the
+//spirit of Tendermint's FuzzedConnection.
+type FuzzParams struct {
+	ProbDropRW   float64 //chance a single Read/Write fails with io.ErrNoProgress without touching the conn
+	ProbDropConn float64 //chance a single Read/Write instead kills the conn
+	ProbSleep    float64 //chance a single Read/Write sleeps first
+	MaxDelayMs   int     //upper bound (ms) on that sleep
+}
+
+//FuzzConn wraps a net.Conn and injects latency, failed reads/writes and
+//dropped connections (it does not reorder data), so cascade correctness (chunk0-1's shuffle
+//verification in particular) can be exercised under real RPC traffic
+//instead of only in memory.
+type FuzzConn struct {
+	net.Conn
+	params FuzzParams
+	rand   *rand.Rand
+}
+
+func NewFuzzConn(conn net.Conn, params FuzzParams) *FuzzConn {
+	return &FuzzConn{
+		Conn:   conn,
+		params: params,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (fc *FuzzConn) Read(p []byte) (int, error) {
+	if err := fc.fuzz(); err != nil {
+		return 0, err
+	}
+	return fc.Conn.Read(p)
+}
+
+func (fc *FuzzConn) Write(p []byte) (int, error) {
+	if err := fc.fuzz(); err != nil {
+		return 0, err
+	}
+	return fc.Conn.Write(p)
+}
+
+//fuzz applies the configured delay/drop/kill behavior, returning a non-nil
+//error when the call should fail (dropped read/write or dropped connection).
+func (fc *FuzzConn) fuzz() error {
+	if fc.params.ProbSleep > 0 && fc.rand.Float64() < fc.params.ProbSleep {
+		delay := fc.params.MaxDelayMs
+		if delay > 0 {
+			time.Sleep(time.Duration(fc.rand.Intn(delay)) * time.Millisecond)
+		}
+	}
+	if fc.params.ProbDropConn > 0 && fc.rand.Float64() < fc.params.ProbDropConn {
+		fc.Conn.Close()
+		return io.ErrClosedPipe
+	}
+	if fc.params.ProbDropRW > 0 && fc.rand.Float64() < fc.params.ProbDropRW {
+		return io.ErrNoProgress
+	}
+	return nil
+}
+
+//fuzzListener wraps a net.Listener so every accepted connection is wrapped
+//in a FuzzConn with the same params.
+type fuzzListener struct {
+	net.Listener
+	params FuzzParams
+}
+
+func (fl *fuzzListener) Accept() (net.Conn, error) {
+	conn, err := fl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewFuzzConn(conn, fl.params), nil
+}
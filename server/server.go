@@ -1,21 +1,177 @@
 package server
 
 import (
-	// "flag"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"sync"
-	// "time"
+	"time"
 
 	. "afs/lib" //types and utils
 
+	"afs/metrics"
+
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/proof"
 	"github.com/dedis/crypto/shuffle"
 )
 
+//peer dial/reconnect tuning. dialDeadline/peerHealthInterval are just the
+//defaults: SetDialDeadline/SetPeerHealthInterval override them per-Server.
+const (
+	dialInitialBackoff = 100 * time.Millisecond
+	dialMaxBackoff      = 5 * time.Second
+	defaultDialDeadline       = 30 * time.Second
+	defaultPeerHealthInterval = 2 * time.Second
+	callRetries         = 5
+	callRetryWait       = 200 * time.Millisecond
+)
+
+//ShuffleBatch is what gets passed from one mix server to the next. Uploads
+//carries the re-blinded ciphertexts to shuffle next; PrevXs/PrevYs/Ybars/Prfs
+//carry the sender's own shuffle proof so the receiver can verify it before
+//accepting the batch into the cascade. Hops carries every hop's transcript
+//so far, so the last server can broadcast the whole chain.
+type ShuffleBatch struct {
+	Round   int
+	Uploads []UpBlock
+	Hops    []HopTranscript //every earlier hop's transcript, in cascade order
+
+	PrevXs [][]byte //sender's pre-shuffle X, per chunk (points concatenated)
+	PrevYs [][]byte //sender's pre-shuffle Y, per chunk (points concatenated)
+	Ybars  [][]byte //sender's shuffled (still-encrypted) Y, per chunk (points concatenated)
+	Prfs   [][]byte   //sender's HashProve transcript, per chunk
+}
+
+//HopTranscript is one server's contribution to a round's publicly verifiable
+//shuffle transcript: (pk_i, Xs_i, Ys_i, Xbars_i, Ybars_i, prf_i).
+type HopTranscript struct {
+	ServerId int
+	PK       []byte
+	Xs       [][]byte
+	Ys       [][]byte
+	Xbars    [][]byte
+	Ybars    [][]byte
+	Prfs     [][]byte
+}
+
+//RoundTranscript is the full cascade transcript for a round, broadcast by
+//the last mix server once every hop has shuffled.
+type RoundTranscript struct {
+	Round int
+	Hops  []HopTranscript
+}
+
+//serverMetrics holds every metric handle up front so the hot paths in
+//shuffleUploads, handleResponse, handleRequest, gatherUploads and
+//GetResponse only ever do arithmetic on an existing handle, never allocate
+//or format a metric name at event time.
+type serverMetrics struct {
+	reg *metrics.Registry
+
+	blocksUploaded  *metrics.Counter
+	responsesServed *metrics.Counter
+	shuffleFailures *metrics.Counter
+
+	roundLatency   *metrics.Histogram
+	shuffleLatency *metrics.Histogram
+	reqHashLatency *metrics.Histogram
+	peerRPCLatency []*metrics.Histogram //one per peer, indexed like s.servers
+
+	totalClients     *metrics.Gauge
+	ublockChanDepth   *metrics.Gauge
+	shuffleChanDepth  *metrics.Gauge
+	dblocksChanDepth  *metrics.Gauge
+}
+
+func newServerMetrics(numPeers int) *serverMetrics {
+	reg := metrics.NewRegistry()
+	m := &serverMetrics{
+		reg: reg,
+
+		blocksUploaded:  reg.NewCounter("riffle_blocks_uploaded_total"),
+		responsesServed: reg.NewCounter("riffle_responses_served_total"),
+		shuffleFailures: reg.NewCounter("riffle_shuffle_proof_failures_total"),
+
+		roundLatency:   reg.NewHistogram("riffle_round_latency_ms"),
+		shuffleLatency: reg.NewHistogram("riffle_shuffle_latency_ms"),
+		reqHashLatency: reg.NewHistogram("riffle_request_hash_latency_ms"),
+		peerRPCLatency: make([]*metrics.Histogram, numPeers),
+
+		totalClients:     reg.NewGauge("riffle_total_clients"),
+		ublockChanDepth:  reg.NewGauge("riffle_ublock_chan_depth"),
+		shuffleChanDepth: reg.NewGauge("riffle_shuffle_chan_depth"),
+		dblocksChanDepth: reg.NewGauge("riffle_dblocks_chan_depth"),
+	}
+	for i := range m.peerRPCLatency {
+		m.peerRPCLatency[i] = reg.NewHistogram(fmt.Sprintf("riffle_peer_rpc_latency_ms_%d", i))
+	}
+	return m
+}
+
+//Stats is a point-in-time snapshot of a Server's metrics, for tests and
+//anything else that wants numbers without scraping the HTTP endpoint.
+type Stats struct {
+	TotalClients    int64
+	BlocksUploaded  int64
+	ResponsesServed int64
+	ShuffleFailures int64
+
+	RoundLatencyCount   int64
+	RoundLatencySumMs   float64
+	ShuffleLatencyCount int64
+	ShuffleLatencySumMs float64
+}
+
+//Stats returns a snapshot of this server's metrics.
+func (s *Server) Stats() Stats {
+	roundCount, roundSum := s.metrics.roundLatency.Snapshot()
+	shuffleCount, shuffleSum := s.metrics.shuffleLatency.Snapshot()
+	return Stats{
+		TotalClients:    s.metrics.totalClients.Value(),
+		BlocksUploaded:  s.metrics.blocksUploaded.Value(),
+		ResponsesServed: s.metrics.responsesServed.Value(),
+		ShuffleFailures: s.metrics.shuffleFailures.Value(),
+
+		RoundLatencyCount:   roundCount,
+		RoundLatencySumMs:   roundSum,
+		ShuffleLatencyCount: shuffleCount,
+		ShuffleLatencySumMs: shuffleSum,
+	}
+}
+
+//ServeMetrics starts the optional Prometheus HTTP endpoint on addr (e.g.
+//":9100"). A zero-length addr leaves metrics un-exposed (Stats still works).
+func (s *Server) ServeMetrics(addr string) error {
+	return s.metrics.reg.ListenAndServe(addr)
+}
+
+func marshalPointMatrix(m [][]abstract.Point) [][]byte {
+	out := make([][]byte, len(m))
+	for i := range m {
+		out[i] = marshalPointSlice(m[i])
+	}
+	return out
+}
+
+func marshalPointSlice(pts []abstract.Point) []byte {
+	out := make([]byte, 0, len(pts)*SecretSize)
+	for _, p := range pts {
+		out = append(out, MarshalPoint(p)...)
+	}
+	return out
+}
+
+func unmarshalPointSlice(b []byte) []abstract.Point {
+	n := len(b) / SecretSize
+	out := make([]abstract.Point, n)
+	for i := 0; i < n; i++ {
+		out[i] = UnmarshalPoint(b[i*SecretSize : (i+1)*SecretSize])
+	}
+	return out
+}
+
 //any variable/func with 2: similar object as s-c but only s-s
 type Server struct {
 	addr            string //this server
@@ -23,6 +179,13 @@ type Server struct {
 	id              int
 	servers         []string //other servers
 	rpcServers      []*rpc.Client
+	rpcLock         sync.RWMutex //guards rpcServers while peers reconnect
+	listener        net.Listener
+	closeCh         chan struct{}
+	watchWG         sync.WaitGroup //peer-monitor goroutines
+	fuzz            *FuzzParams //non-nil only in fault-injection tests
+	dialDeadline       time.Duration //overridable via SetDialDeadline
+	peerHealthInterval time.Duration //overridable via SetPeerHealthInterval
 	regLock         []*sync.Mutex //registration mutex
 	regDone         bool
 
@@ -50,7 +213,14 @@ type Server struct {
 	//uploading
 	ublockChan      chan UpBlock
 	ublockChan2     chan UpBlock
-	shuffleChan     chan []UpBlock //collect all uploads together
+	shuffleChan     chan ShuffleBatch //collect all uploads together
+
+	//shuffle verification
+	roundNum        int
+	transLock       sync.Mutex
+	transcripts     map[int][]HopTranscript //full cascade transcript, keyed by round
+
+	metrics         *serverMetrics
 
 	//downloading
 	upHashes        [][]byte
@@ -62,6 +232,11 @@ type Server struct {
 	maskChan        chan []byte
 	masks           [][]byte //clients' masks for PIR
 	secrets         [][]byte //shared secret used to xor
+
+	//batched downloading (GetResponses/GetResponses2): broadcasts "this
+	//round's allBlocks is ready" without being keyed to one client id
+	blocksReadyMu sync.Mutex
+	blocksReadyCh chan struct{}
 }
 
 
@@ -79,8 +254,11 @@ func NewServer(addr string, port int, id int, servers []string) *Server {
 		port:           port,
 		id:             id,
 		servers:        servers,
+		closeCh:        make(chan struct{}),
 		regLock:        []*sync.Mutex{new(sync.Mutex), new(sync.Mutex)},
 		regDone:        false,
+		dialDeadline:       defaultDialDeadline,
+		peerHealthInterval: defaultPeerHealthInterval,
 
 		g:              Suite,
 		rand:           rand,
@@ -101,7 +279,11 @@ func NewServer(addr string, port int, id int, servers []string) *Server {
 
 		ublockChan:     make(chan UpBlock),
 		ublockChan2:    make(chan UpBlock),
-		shuffleChan:    make(chan []UpBlock),
+		shuffleChan:    make(chan ShuffleBatch),
+
+		roundNum:       0,
+		transcripts:    make(map[int][]HopTranscript),
+		metrics:        newServerMetrics(len(servers)),
 
 		upHashes:       nil,
 		dblocksChan:    make(chan []Block),
@@ -111,6 +293,8 @@ func NewServer(addr string, port int, id int, servers []string) *Server {
 		xorsChan:       make([]map[int](chan Block), len(servers)),
 		masks:          nil,
 		secrets:        nil,
+
+		blocksReadyCh:  make(chan struct{}),
 	}
 
 	return &s
@@ -121,6 +305,27 @@ func NewServer(addr string, port int, id int, servers []string) *Server {
 //Helpers
 ////////////////////////////////
 
+//SetFuzzParams enables fault-injection on every connection this server
+//dials or accepts from here on; it must be called before MainLoop/
+//ConnectServers. Test-only.
+func (s *Server) SetFuzzParams(p FuzzParams) {
+	s.fuzz = &p
+}
+
+//SetDialDeadline overrides how long dialPeer/reconnectPeer retry an
+//unreachable peer before giving up, in place of the defaultDialDeadline.
+//Must be called before ConnectServers.
+func (s *Server) SetDialDeadline(d time.Duration) {
+	s.dialDeadline = d
+}
+
+//SetPeerHealthInterval overrides how often watchPeer health-checks each
+//peer, in place of defaultPeerHealthInterval. Must be called before
+//ConnectServers.
+func (s *Server) SetPeerHealthInterval(d time.Duration) {
+	s.peerHealthInterval = d
+}
+
 func (s *Server) MainLoop() {
 	rpcServer := rpc.NewServer()
 	rpcServer.Register(s)
@@ -128,6 +333,10 @@ func (s *Server) MainLoop() {
 	if err != nil {
 		panic("Cannot starting listening to the port")
 	}
+	if s.fuzz != nil {
+		l = &fuzzListener{Listener: l, params: *s.fuzz}
+	}
+	s.listener = l
 	go rpcServer.Accept(l)
 
 	RunFunc(s.handleResponse)
@@ -137,20 +346,70 @@ func (s *Server) MainLoop() {
 	RunFunc(s.handleRequest)
 }
 
+//peerAddr returns the dial address for peer i (i==s.id dials back to self)
+func (s *Server) peerAddr(i int) string {
+	if i == s.id {
+		return fmt.Sprintf("127.0.0.1:%d", s.port)
+	}
+	return s.servers[i]
+}
+
+//dialWithBackoff retries rpc.Dial with exponential backoff until it
+//succeeds or deadline elapses
+func dialWithBackoff(addr string, deadline time.Duration) (*rpc.Client, error) {
+	backoff := dialInitialBackoff
+	giveUp := time.Now().Add(deadline)
+	var lastErr error
+	for {
+		rpcServer, err := rpc.Dial("tcp", addr)
+		if err == nil {
+			return rpcServer, nil
+		}
+		lastErr = err
+		if time.Now().After(giveUp) {
+			return nil, fmt.Errorf("could not dial %s within %s: %v", addr, deadline, lastErr)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > dialMaxBackoff {
+			backoff = dialMaxBackoff
+		}
+	}
+}
+
+//dialPeer dials addr, wrapping the connection in a FuzzConn first when this
+//server has fuzz params configured (see SetFuzzParams).
+func (s *Server) dialPeer(addr string, deadline time.Duration) (*rpc.Client, error) {
+	if s.fuzz == nil {
+		return dialWithBackoff(addr, deadline)
+	}
+
+	backoff := dialInitialBackoff
+	giveUp := time.Now().Add(deadline)
+	var lastErr error
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return rpc.NewClient(NewFuzzConn(conn, *s.fuzz)), nil
+		}
+		lastErr = err
+		if time.Now().After(giveUp) {
+			return nil, fmt.Errorf("could not dial %s within %s: %v", addr, deadline, lastErr)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > dialMaxBackoff {
+			backoff = dialMaxBackoff
+		}
+	}
+}
+
 func (s *Server) ConnectServers() {
 	rpcServers := make([]*rpc.Client, len(s.servers))
 	for i := range rpcServers {
-		var rpcServer *rpc.Client
-		var err error
-		if i == s.id {
-			//make a local rpc
-			addr := fmt.Sprintf("127.0.0.1:%d", s.port)
-			rpcServer, err = rpc.Dial("tcp", addr)
-		} else {
-			rpcServer, err = rpc.Dial("tcp", s.servers[i])
-		}
+		rpcServer, err := s.dialPeer(s.peerAddr(i), s.dialDeadline)
 		if err != nil {
-			log.Fatal("Cannot establish connection")
+			log.Fatal("Cannot establish connection: ", err)
 		}
 		rpcServers[i] = rpcServer
 	}
@@ -177,13 +436,131 @@ func (s *Server) ConnectServers() {
 	} else {
 		s.nextPk = s.pk
 	}
+
+	s.rpcLock.Lock()
 	s.rpcServers = rpcServers
+	s.rpcLock.Unlock()
+
+	for i := range rpcServers {
+		s.watchWG.Add(1)
+		go s.watchPeer(i)
+	}
+}
+
+//watchPeer periodically health-checks peer i and redials it (with the same
+//backoff as the initial connect) whenever the call fails, so a restarted or
+//slow-to-come-up peer doesn't take the whole cascade down
+func (s *Server) watchPeer(i int) {
+	defer s.watchWG.Done()
+	ticker := time.NewTicker(s.peerHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+			s.rpcLock.RLock()
+			client := s.rpcServers[i]
+			s.rpcLock.RUnlock()
+			pk := make([]byte, SecretSize)
+			if err := client.Call("Server.GetPK", 0, &pk); err == nil {
+				continue
+			}
+			s.reconnectPeer(i)
+		}
+	}
+}
+
+//reconnectPeer redials peer i, confirms it is still the same public key
+//(not some other node that came up on the same address), and swaps the new
+//client into place under rpcLock
+func (s *Server) reconnectPeer(i int) {
+	addr := s.peerAddr(i)
+	newClient, err := s.dialPeer(addr, s.dialDeadline)
+	if err != nil {
+		log.Println("riffle: giving up reconnecting to", addr, ":", err)
+		return
+	}
+	pk := make([]byte, SecretSize)
+	if err := newClient.Call("Server.GetPK", 0, &pk); err != nil {
+		log.Println("riffle: reconnected to", addr, "but couldn't confirm its pk: ", err)
+		newClient.Close()
+		return
+	}
+	if !UnmarshalPoint(pk).Equal(s.pks[i]) {
+		log.Println("riffle: peer at", addr, "came back with a different pk, refusing to swap in")
+		newClient.Close()
+		return
+	}
+
+	s.rpcLock.Lock()
+	old := s.rpcServers[i]
+	s.rpcServers[i] = newClient
+	s.rpcLock.Unlock()
+	old.Close()
+}
+
+//call invokes serviceMethod on peer i, waiting (bounded) for a reconnect to
+//land instead of crashing the process if the peer is mid-redial
+func (s *Server) call(i int, serviceMethod string, args interface{}, reply interface{}) error {
+	start := time.Now()
+	defer func() { s.metrics.peerRPCLatency[i].ObserveDuration(time.Since(start)) }()
+
+	var lastErr error
+	for attempt := 0; attempt < callRetries; attempt++ {
+		s.rpcLock.RLock()
+		client := s.rpcServers[i]
+		s.rpcLock.RUnlock()
+
+		err := client.Call(serviceMethod, args, reply)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(rpc.ServerError); ok {
+			//the peer is alive and answered; this is serviceMethod's own
+			//business-logic error (e.g. ShuffleBlocks rejecting a bad proof),
+			//not a transport failure, so it's neither retryable nor a signal
+			//to reconnect
+			return err
+		}
+		lastErr = err
+		//net/rpc only returns ErrShutdown on calls made *after* a client has
+		//noticed its connection is dead; the first call to fail after a peer
+		//actually drops gets the raw I/O error instead, so retrying only on
+		//ErrShutdown let that first failure straight through. Reconnect here
+		//on any error rather than waiting on watchPeer's ticker, which can
+		//lag a full peerHealthInterval behind the failure.
+		s.reconnectPeer(i)
+		time.Sleep(callRetryWait)
+	}
+	return fmt.Errorf("%s to peer %d still failing after %d attempts: %v", serviceMethod, i, callRetries, lastErr)
+}
+
+//Close tears down the peer-monitor goroutines, closes all peer connections,
+//and stops the RPC accept loop
+func (s *Server) Close() {
+	close(s.closeCh)
+	s.watchWG.Wait()
+
+	s.rpcLock.Lock()
+	for _, c := range s.rpcServers {
+		if c != nil {
+			c.Close()
+		}
+	}
+	s.rpcLock.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
 }
 
 func (s *Server) handleRequest() {
 	if !s.regDone {
 		return
 	}
+	start := time.Now()
+	defer func() { s.metrics.reqHashLatency.ObserveDuration(time.Since(start)) }()
 
 	allRequests := make([][][]byte, s.totalClients)
 
@@ -213,6 +590,16 @@ func (s *Server) handleResponse() {
 	}
 
 	allBlocks := <-s.dblocksChan
+	s.metrics.dblocksChanDepth.Dec()
+	//close the batched-download gate again while s.allBlocks is swapped for
+	//this round's blocks
+	s.blocksReadyMu.Lock()
+	select {
+	case <-s.blocksReadyCh:
+		s.blocksReadyCh = make(chan struct{})
+	default:
+	}
+	s.blocksReadyMu.Unlock()
 	for i := 0; i < s.totalClients; i++ {
 		if s.clientMap[i] == s.id {
 			continue
@@ -228,7 +615,7 @@ func (s *Server) handleResponse() {
 					Round: 0,
 				},
 			}
-			err := s.rpcServers[sid].Call("Server.PutClientBlock", cb, nil)
+			err := s.call(sid, "Server.PutClientBlock", cb, nil)
 			if err != nil {
 				log.Fatal("Couldn't put block: ", err)
 			}
@@ -237,6 +624,7 @@ func (s *Server) handleResponse() {
 
 	//store it on this server as well
 	s.allBlocks = allBlocks
+	s.signalBlocksReady()
 
 	for i := range s.blocksRdy {
 		if s.clientMap[i] != s.id {
@@ -246,13 +634,36 @@ func (s *Server) handleResponse() {
 	}
 }
 
+//signalBlocksReady opens the gate that GetResponses/GetResponses2 wait on in
+//waitBlocksReady: every call currently blocked there wakes, and later calls
+//pass straight through until handleResponse closes the gate again for the
+//next round's blocks. Unlike blocksRdy (one channel per client id), this
+//isn't keyed to any particular client, since the batched path doesn't know
+//its caller's client ids ahead of time.
+func (s *Server) signalBlocksReady() {
+	s.blocksReadyMu.Lock()
+	defer s.blocksReadyMu.Unlock()
+	select {
+	case <-s.blocksReadyCh: //already open
+	default:
+		close(s.blocksReadyCh)
+	}
+}
+
+func (s *Server) waitBlocksReady() {
+	s.blocksReadyMu.Lock()
+	ch := s.blocksReadyCh
+	s.blocksReadyMu.Unlock()
+	<-ch
+}
+
 func (s *Server) handleUpload() {
 	if !s.regDone {
 		return
 	}
 
 	upBlock := <-s.ublockChan
-	err := s.rpcServers[0].Call("Server.UploadBlock2", upBlock, nil)
+	err := s.call(0, "Server.UploadBlock2", upBlock, nil)
 	if err != nil {
 		log.Fatal("Couldn't send block to first server: ", err)
 	}
@@ -266,8 +677,13 @@ func (s *Server) gatherUploads() {
 	allUploads := make([]UpBlock, s.totalClients)
 	for i := 0; i < s.totalClients; i++ {
 		allUploads[i] = <-s.ublockChan2
+		s.metrics.ublockChanDepth.Dec()
+	}
+	s.metrics.shuffleChanDepth.Inc()
+	s.shuffleChan <- ShuffleBatch{
+		Round:   s.nextRound(),
+		Uploads: allUploads,
 	}
-	s.shuffleChan <- allUploads
 }
 
 func (s *Server) shuffleUploads() {
@@ -275,7 +691,12 @@ func (s *Server) shuffleUploads() {
 		return
 	}
 
-	allUploads := <-s.shuffleChan
+	roundStart := time.Now()
+	defer func() { s.metrics.roundLatency.ObserveDuration(time.Since(roundStart)) }()
+
+	batch := <-s.shuffleChan
+	s.metrics.shuffleChanDepth.Dec()
+	allUploads := batch.Uploads
 	//shuffle and reblind
 
 	numBlockChunks := len(allUploads[0].BC1)
@@ -306,8 +727,23 @@ func (s *Server) shuffleUploads() {
 		}
 	}
 
-	//TODO: need to send ybar and proofs out out eventually
-	Xbars, _, decs, _ := s.shuffle(BXs, BYs, numBlockChunks)
+	shuffleStart := time.Now()
+	Xbars, Ybars, decs, prfs := s.shuffle(BXs, BYs, numBlockChunks)
+	s.metrics.shuffleLatency.ObserveDuration(time.Since(shuffleStart))
+
+	hop := HopTranscript{
+		ServerId: s.id,
+		PK:       MarshalPoint(s.pk),
+		Xs:       marshalPointMatrix(BXs),
+		Ys:       marshalPointMatrix(BYs),
+		Xbars:    marshalPointMatrix(Xbars),
+		Ybars:    marshalPointMatrix(Ybars),
+		Prfs:     prfs,
+	}
+	for _, prev := range batch.Hops {
+		s.recordHop(batch.Round, prev)
+	}
+	s.recordHop(batch.Round, hop)
 
 	if s.id == len(s.servers) - 1 {
 		//last server to shuffle, broadcast
@@ -326,16 +762,22 @@ func (s *Server) shuffleUploads() {
 				Round: 0,
 			}
 		}
+
+		transcript := s.fullTranscript(batch.Round)
 		var wg sync.WaitGroup
-		for _, rpcServer := range s.rpcServers {
+		for i := range s.servers {
 			wg.Add(1)
-			go func(rpcServer *rpc.Client) {
+			go func(i int) {
 				defer wg.Done()
-				err := rpcServer.Call("Server.PutUploadedBlocks", &blocks, nil)
+				err := s.call(i, "Server.PutUploadedBlocks", &blocks, nil)
 				if err != nil {
 					log.Fatal("Failed uploading shuffled and decoded blocks: ", err)
 				}
-			} (rpcServer)
+				err = s.call(i, "Server.PutTranscript", &RoundTranscript{Round: batch.Round, Hops: transcript}, nil)
+				if err != nil {
+					log.Fatal("Failed broadcasting shuffle transcript: ", err)
+				}
+			} (i)
 		}
 		wg.Wait()
 	} else {
@@ -345,11 +787,60 @@ func (s *Server) shuffleUploads() {
 				allUploads[i].BC2[j] = MarshalPoint(decs[j][i])
 			}
 		}
-		err := s.rpcServers[s.id+1].Call("Server.ShuffleBlocks", allUploads, nil)
+		next := ShuffleBatch{
+			Round:   batch.Round,
+			Uploads: allUploads,
+			Hops:    s.fullTranscript(batch.Round),
+			PrevXs:  hop.Xs,
+			PrevYs:  hop.Ys,
+			Ybars:   hop.Ybars,
+			Prfs:    hop.Prfs,
+		}
+		err := s.call(s.id+1, "Server.ShuffleBlocks", next, nil)
 		if err != nil {
-			log.Fatal("Failed requesting shuffle: ", err)
+			//the next hop rejected (or couldn't be reached for) this round;
+			//abort the round locally rather than taking down an otherwise
+			//healthy sending server over one bad/unreachable downstream peer
+			log.Println("riffle: round", batch.Round, "aborted: next hop rejected shuffle batch:", err)
+			return
+		}
+	}
+}
+
+//verifies the previous hop's shuffle proof (pk, Xs, Ys -> Xbars, Ybars) before
+//the batch is allowed into the cascade; a failure aborts the round instead of
+//silently forwarding garbage plaintexts
+func (s *Server) verifyShuffle(prevPk abstract.Point, Xs, Ys, Xbars, Ybars [][]abstract.Point, prfs [][]byte) error {
+	for i := range Xs {
+		v := shuffle.Shuffle2Verifier(s.g, nil, prevPk, Xs[i], Ys[i], Xbars[i], Ybars[i])
+		if err := proof.HashVerify(Suite, "PairShuffle", v, prfs[i]); err != nil {
+			return fmt.Errorf("shuffle proof failed for chunk %d: %v", i, err)
 		}
 	}
+	return nil
+}
+
+func (s *Server) nextRound() int {
+	s.transLock.Lock()
+	defer s.transLock.Unlock()
+	r := s.roundNum
+	s.roundNum++
+	return r
+}
+
+func (s *Server) recordHop(round int, hop HopTranscript) {
+	s.transLock.Lock()
+	defer s.transLock.Unlock()
+	s.transcripts[round] = append(s.transcripts[round], hop)
+}
+
+//fullTranscript returns the complete per-hop chain recorded so far for round
+func (s *Server) fullTranscript(round int) []HopTranscript {
+	s.transLock.Lock()
+	defer s.transLock.Unlock()
+	full := make([]HopTranscript, len(s.transcripts[round]))
+	copy(full, s.transcripts[round])
+	return full
 }
 
 func (s *Server) shuffle(Xs [][]abstract.Point, Ys [][]abstract.Point, numChunks int) ([][]abstract.Point,
@@ -406,8 +897,8 @@ func (s *Server) Register(client *ClientRegistration, clientId *int) error {
 	*clientId = s.totalClients
 	s.totalClients++
 	s.regLock[0].Unlock()
-	for _, rpcServer := range s.rpcServers {
-		err := rpcServer.Call("Server.Register2", client, nil)
+	for i := range s.servers {
+		err := s.call(i, "Server.Register2", client, nil)
 		if err != nil {
 			log.Fatal(fmt.Sprintf("Cannot connect to %d: ", client.ServerId), err)
 		}
@@ -428,8 +919,8 @@ func (s *Server) Register2(client *ClientRegistration, _ *int) error {
 }
 
 func (s *Server) RegisterDone() {
-	for _, rpcServer := range s.rpcServers {
-		err := rpcServer.Call("Server.RegisterDone2", s.totalClients, nil)
+	for i := range s.servers {
+		err := s.call(i, "Server.RegisterDone2", s.totalClients, nil)
 		if err != nil {
 			log.Fatal("Cannot update num clients")
 		}
@@ -438,6 +929,7 @@ func (s *Server) RegisterDone() {
 
 func (s *Server) RegisterDone2(numClients int, _ *int) error {
 	s.totalClients = numClients
+	s.metrics.totalClients.Set(int64(numClients))
 	for i := 0; i < len(s.servers); i++ {
 		s.xorsChan[i] = make(map[int](chan Block))
 		for j := 0; j < numClients; j++ {
@@ -507,15 +999,15 @@ func (s *Server) ShareSecret(clientDH *ClientDH, serverPub *[]byte) error {
 ////////////////////////////////
 func (s *Server) RequestBlock(cr *ClientRequest, _ *int) error {
 	var wg sync.WaitGroup
-	for i, rpcServer := range s.rpcServers {
+	for i := range s.servers {
 		wg.Add(1)
-		go func (i int, rpcServer *rpc.Client) {
+		go func (i int) {
 			defer wg.Done()
-			err := rpcServer.Call("Server.ShareRequest", cr, nil)
+			err := s.call(i, "Server.ShareRequest", cr, nil)
 			if err != nil {
 				log.Fatal("Couldn't share request: ", err)
 			}
-		} (i, rpcServer)
+		} (i)
 	}
 	wg.Wait()
 	return nil
@@ -541,12 +1033,57 @@ func (s *Server) UploadBlock(block *UpBlock, _ *int) error {
 }
 
 func (s *Server) UploadBlock2(block *UpBlock, _*int) error {
+	s.metrics.blocksUploaded.Inc()
+	s.metrics.ublockChanDepth.Inc()
 	s.ublockChan2 <- *block
 	return nil
 }
 
-func (s *Server) ShuffleBlocks(blocks *[]UpBlock, _*int) error {
-	s.shuffleChan <- *blocks
+func (s *Server) ShuffleBlocks(batch ShuffleBatch, _*int) error {
+	if s.id > 0 {
+		numChunks := len(batch.PrevXs)
+		Xs := make([][]abstract.Point, numChunks)
+		Ys := make([][]abstract.Point, numChunks)
+		Xbars := make([][]abstract.Point, numChunks)
+		Ybars := make([][]abstract.Point, numChunks)
+		for i := 0; i < numChunks; i++ {
+			Xs[i] = unmarshalPointSlice(batch.PrevXs[i])
+			Ys[i] = unmarshalPointSlice(batch.PrevYs[i])
+			Ybars[i] = unmarshalPointSlice(batch.Ybars[i])
+			Xbars[i] = make([]abstract.Point, len(batch.Uploads))
+			for j, upload := range batch.Uploads {
+				Xbars[i][j] = UnmarshalPoint(upload.BC1[i])
+			}
+		}
+		//the prover blinded under its own cumulative key (its individual pk
+		//plus every pk from there to the last server, see shuffle()'s
+		//pk := s.nextPk), so the verifier must reconstruct that same sum
+		//rather than check against the previous hop's bare individual key
+		prevPk := s.g.Point().Add(s.pks[s.id-1], s.nextPk)
+		if err := s.verifyShuffle(prevPk, Xs, Ys, Xbars, Ybars, batch.Prfs); err != nil {
+			s.metrics.shuffleFailures.Inc()
+			return fmt.Errorf("round %d: rejecting shuffle batch: %v", batch.Round, err)
+		}
+	}
+	s.metrics.shuffleChanDepth.Inc()
+	s.shuffleChan <- batch
+	return nil
+}
+
+//PutTranscript stores the fully-assembled cascade transcript for round so
+//that clients (or any external auditor) can re-verify the shuffle offline
+func (s *Server) PutTranscript(rt *RoundTranscript, _ *int) error {
+	s.transLock.Lock()
+	defer s.transLock.Unlock()
+	s.transcripts[rt.Round] = rt.Hops
+	return nil
+}
+
+//GetTranscript returns the stored cascade transcript for round, if any
+func (s *Server) GetTranscript(round int, hops *[]HopTranscript) error {
+	s.transLock.Lock()
+	defer s.transLock.Unlock()
+	*hops = s.transcripts[round]
 	return nil
 }
 
@@ -580,6 +1117,7 @@ func (s *Server) GetResponse(cmask ClientMask, response *[]byte) error {
 	r := ComputeResponse(s.allBlocks, cmask.Mask, s.secrets[cmask.Id])
 	Xor(Xors(otherBlocks), r)
 	*response = r
+	s.metrics.responsesServed.Inc()
 	return nil
 }
 
@@ -604,6 +1142,7 @@ func (s *Server) PutUploadedBlocks(blocks *[]Block, _ *int) error {
 		go func(i int) {s.upHashesRdy[i] <- true}(i)
 	}
 
+	s.metrics.dblocksChanDepth.Inc()
 	s.dblocksChan <- *blocks
 	return nil
 }
@@ -620,17 +1159,5 @@ func (s *Server) Secrets() [][]byte {
 	return s.secrets
 }
 
-/////////////////////////////////
-//MAIN
-/////////////////////////////////
-func main() {
-	// var addr *string = flag.String("a", "addr", "addr [address]")
-	// var id *int = flag.Int("i", "id", "id [num]")
-	// var port *int = flag.Int("p", "port", "port [num]")
-	// var servers *string = flag.Strin("s", "servers", "servers [servers list]")
-
-	// var ss []string
-
-	// s := NewServer(*addr, *port, *id, ss)
-	// //s.ConnectServers()
-}
+//the daemon entry point lives in cmd/riffle-server; see ServerConfig and
+//LoadConfig for how a Server gets built from a YAML file.
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/dedis/crypto/abstract"
+)
+
+//The full client upload/download flow lives in the (separate) client
+//package, so this suite exercises the server-to-server surface in-process
+//and over real RPC connections: cascade liveness, persistent peer
+//reconnection (chunk0-2) including under a fuzzed transport (chunk0-5), the
+//shuffle-proof accept/reject paths (chunk0-1), and each ByzantineServer
+//fault mode driven through a real multi-hop cascade (chunk0-5).
+
+func freeAddrs(basePort int, n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", basePort+i)
+	}
+	return addrs
+}
+
+func startCascade(addrs []string) []*Server {
+	servers := make([]*Server, len(addrs))
+	for i, addr := range addrs {
+		port := 0
+		fmt.Sscanf(addr[len("127.0.0.1:"):], "%d", &port)
+		servers[i] = NewServer(addr, port, i, addrs)
+		servers[i].MainLoop()
+	}
+	for _, s := range servers {
+		s.ConnectServers()
+	}
+	return servers
+}
+
+func closeAll(servers []*Server) {
+	for _, s := range servers {
+		s.Close()
+	}
+}
+
+func TestCascadeLiveness(t *testing.T) {
+	addrs := freeAddrs(19100, 3)
+	servers := startCascade(addrs)
+	defer closeAll(servers)
+
+	for i, s := range servers {
+		if len(s.pks) != len(addrs) {
+			t.Fatalf("server %d: expected %d peer pks, got %d", i, len(addrs), len(s.pks))
+		}
+		for j := range s.pks {
+			if s.pks[j] == nil {
+				t.Fatalf("server %d: never learned peer %d's pk", i, j)
+			}
+		}
+	}
+}
+
+func TestPeerReconnect(t *testing.T) {
+	addrs := freeAddrs(19110, 2)
+	servers := startCascade(addrs)
+	defer closeAll(servers)
+
+	s0, s1 := servers[0], servers[1]
+
+	//simulate peer 1 restarting: tear down its listener and rebind the
+	//same port a little later, the way a crashed process would come back
+	s1.listener.Close()
+	//closing the listener leaves already-accepted connections open, so also
+	//drop s0's existing client to peer 1, as a crashed peer would
+	s0.rpcLock.RLock()
+	s0.rpcServers[1].Close()
+	s0.rpcLock.RUnlock()
+	time.Sleep(50 * time.Millisecond)
+
+	l, err := net.Listen("tcp", addrs[1])
+	if err != nil {
+		t.Fatalf("could not rebind %s: %v", addrs[1], err)
+	}
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(s1)
+	s1.listener = l
+	go rpcServer.Accept(l)
+
+	//give s0's background peer-monitor time to notice and redial
+	time.Sleep(s0.peerHealthInterval * 3)
+
+	var pk []byte
+	if err := s0.call(1, "Server.GetPK", 0, &pk); err != nil {
+		t.Fatalf("server 0 failed to reach peer 1 after its restart: %v", err)
+	}
+}
+
+//honestFirstHopBatch drives s0's real shuffle() the way shuffleUploads does
+//for a non-last server, so tests can feed a genuine shuffle batch (valid
+//proof, correctly blinded under the cumulative downstream key) into the
+//next hop without standing up the full registration/upload pipeline.
+func honestFirstHopBatch(s0 *Server, numClients, numChunks int) ShuffleBatch {
+	s0.totalClients = numClients
+	base := MarshalPoint(s0.g.Point().Base())
+
+	uploads := make([]UpBlock, numClients)
+	Xs := make([][]abstract.Point, numChunks)
+	Ys := make([][]abstract.Point, numChunks)
+	for c := 0; c < numChunks; c++ {
+		Xs[c] = make([]abstract.Point, numClients)
+		Ys[c] = make([]abstract.Point, numClients)
+		for i := 0; i < numClients; i++ {
+			Xs[c][i] = UnmarshalPoint(base)
+			Ys[c][i] = UnmarshalPoint(base)
+		}
+	}
+	for i := range uploads {
+		uploads[i] = UpBlock{BC1: make([][]byte, numChunks), BC2: make([][]byte, numChunks)}
+	}
+
+	Xbars, Ybars, decs, prfs := s0.shuffle(Xs, Ys, numChunks)
+	for i := range uploads {
+		for j := range uploads[i].BC1 {
+			uploads[i].BC1[j] = MarshalPoint(Xbars[j][i])
+			uploads[i].BC2[j] = MarshalPoint(decs[j][i])
+		}
+	}
+
+	return ShuffleBatch{
+		Round:   0,
+		Uploads: uploads,
+		PrevXs:  marshalPointMatrix(Xs),
+		PrevYs:  marshalPointMatrix(Ys),
+		Ybars:   marshalPointMatrix(Ybars),
+		Prfs:    prfs,
+	}
+}
+
+//TestHonestShuffleVerifiesAcrossHops drives a real two-server cascade
+//through one honest shuffle round and asserts the receiving hop's
+//verifyShuffle call *accepts* it. TestShuffleVerificationRejectsBadProof
+//only exercises the rejection path; without this test a prevPk mismatch
+//(verifying against the wrong key) could break every genuine shuffle and
+//still show the feature as "tested".
+func TestHonestShuffleVerifiesAcrossHops(t *testing.T) {
+	addrs := freeAddrs(19140, 2)
+	servers := startCascade(addrs)
+	defer closeAll(servers)
+	s0, s1 := servers[0], servers[1]
+
+	batch := honestFirstHopBatch(s0, 2, 1)
+
+	//s1.regDone is false (no client ever registered), so the shuffleUploads
+	//loop MainLoop started for s1 returns immediately without draining
+	//shuffleChan; receive accepted batch ourselves so ShuffleBlocks's send
+	//on that unbuffered channel doesn't block forever
+	accepted := make(chan ShuffleBatch, 1)
+	go func() { accepted <- <-s1.shuffleChan }()
+
+	var reply int
+	if err := s1.ShuffleBlocks(batch, &reply); err != nil {
+		t.Fatalf("expected an honest shuffle batch to verify, got: %v", err)
+	}
+	<-accepted
+}
+
+func TestShuffleVerificationRejectsBadProof(t *testing.T) {
+	addrs := freeAddrs(19120, 2)
+	servers := startCascade(addrs)
+	defer closeAll(servers)
+	s1 := servers[1]
+
+	validPoint := MarshalPoint(s1.g.Point().Base())
+	bogus := ShuffleBatch{
+		Round:   0,
+		Uploads: []UpBlock{{BC1: [][]byte{validPoint}, BC2: [][]byte{validPoint}}},
+		PrevXs:  [][]byte{validPoint},
+		PrevYs:  [][]byte{validPoint},
+		Ybars:   [][]byte{validPoint},
+		Prfs:    [][]byte{[]byte("not a real shuffle proof")},
+	}
+
+	var reply int
+	if err := s1.ShuffleBlocks(bogus, &reply); err == nil {
+		t.Fatal("expected a batch with a bogus shuffle proof to be rejected")
+	}
+}
+
+//startByzantineCascade is startCascade, except peer byzIdx runs as a
+//ByzantineServer (registered and served the same RPC name, so it's wire-
+//compatible) instead of an honest Server.
+func startByzantineCascade(addrs []string, byzIdx int, mode ByzantineMode) ([]*Server, *ByzantineServer) {
+	servers := make([]*Server, len(addrs))
+	var byz *ByzantineServer
+	for i, addr := range addrs {
+		port := 0
+		fmt.Sscanf(addr[len("127.0.0.1:"):], "%d", &port)
+		servers[i] = NewServer(addr, port, i, addrs)
+		if i == byzIdx {
+			byz = NewByzantineServer(servers[i], mode)
+			if err := byz.Serve(); err != nil {
+				panic(err) //test helper; caller's t.Fatalf can't run here
+			}
+			continue
+		}
+		servers[i].MainLoop()
+	}
+	for _, s := range servers {
+		s.ConnectServers()
+	}
+	return servers, byz
+}
+
+//TestByzantineServerFaultModesAreRejected drives each fault mode through a
+//real three-server cascade over actual RPC connections (not an in-process
+//call on a single disconnected server): server 0 is honest and produces a
+//genuine first-hop shuffle batch, server 1 runs as a ByzantineServer, and
+//server 2 is the last, honest server. Every mode is expected to make the
+//cascade reject the round somewhere downstream of the byzantine hop, either
+//at server 1 itself (corrupt ciphertext fails verification immediately) or
+//at server 2 (an unshuffled/reordered batch no longer matches server 1's
+//expected proof material).
+func TestByzantineServerFaultModesAreRejected(t *testing.T) {
+	modes := []ByzantineMode{ByzantineSkipDecrypt, ByzantineCorruptCiphertext, ByzantineReorderNoProof}
+	for i, mode := range modes {
+		addrs := freeAddrs(19150+i*10, 3)
+		servers, _ := startByzantineCascade(addrs, 1, mode)
+		s0 := servers[0]
+
+		batch := honestFirstHopBatch(s0, 2, 1)
+
+		client, err := rpc.Dial("tcp", addrs[1])
+		if err != nil {
+			closeAll(servers)
+			t.Fatalf("mode %v: could not dial byzantine server: %v", mode, err)
+		}
+
+		var reply int
+		err = client.Call("Server.ShuffleBlocks", batch, &reply)
+		client.Close()
+		closeAll(servers)
+
+		if err == nil {
+			t.Fatalf("mode %v: expected the cascade to reject the round somewhere past the byzantine hop", mode)
+		}
+	}
+}
+
+//TestGetResponsesFoldsEveryPeerWithoutRacing drives GetResponses across a
+//real three-server cascade, i.e. two peers besides the home server -- the
+//case chunk0-6's GetResponses never had coverage for, since
+//batch_bench_test.go uses a single-server list and calls ComputeResponse
+//directly rather than GetResponses. Each peer's
+//GetResponses2 reply now lands in its own peerOuts[i] slot and out is only
+//folded by one goroutine after wg.Wait(), so this is expected to pass
+//under `go test -race`, unlike the old per-goroutine
+//`for j := range out { xorInto(out[j], peerOut[j]) }`. It also checks the
+//result against the exact XOR of every server's own ComputeResponse, since
+//GetResponses/GetResponses2 still call that once per client per server.
+func TestGetResponsesFoldsEveryPeerWithoutRacing(t *testing.T) {
+	const (
+		numClients = 4
+		blockSize  = 64
+	)
+
+	addrs := freeAddrs(19300, 3)
+	servers := startCascade(addrs)
+	defer closeAll(servers)
+
+	cmasks := make([]ClientMask, numClients)
+	for i := 0; i < numClients; i++ {
+		cmasks[i] = ClientMask{Id: i, Mask: make([]byte, blockSize)}
+		for j := range cmasks[i].Mask {
+			cmasks[i].Mask[j] = byte(i*31 + j)
+		}
+	}
+
+	for _, s := range servers {
+		s.totalClients = numClients
+		s.clientMap = make(map[int]int, numClients)
+		s.secrets = make([][]byte, numClients)
+		s.allBlocks = make([]Block, numClients)
+		for i := 0; i < numClients; i++ {
+			s.clientMap[i] = 0 //every client is homed at server 0
+			s.secrets[i] = make([]byte, SecretSize)
+			for j := range s.secrets[i] {
+				s.secrets[i][j] = byte(s.id*17 + i*5 + j)
+			}
+			s.allBlocks[i] = Block{Block: make([]byte, blockSize)}
+			for j := range s.allBlocks[i].Block {
+				s.allBlocks[i].Block[j] = byte(s.id*13 + i*7 + j)
+			}
+		}
+		s.signalBlocksReady()
+	}
+
+	want := make([][]byte, numClients)
+	for i, cm := range cmasks {
+		want[i] = make([]byte, blockSize)
+		for _, s := range servers {
+			xorInto(want[i], ComputeResponse(s.allBlocks, cm.Mask, s.secrets[cm.Id]))
+		}
+	}
+
+	var got [][]byte
+	if err := servers[0].GetResponses(cmasks, &got); err != nil {
+		t.Fatalf("GetResponses: %v", err)
+	}
+	if len(got) != numClients {
+		t.Fatalf("expected %d responses, got %d", numClients, len(got))
+	}
+	for i := range want {
+		if string(got[i]) != string(want[i]) {
+			t.Fatalf("client %d: response folded across all 3 servers doesn't match, got %x want %x", i, got[i], want[i])
+		}
+	}
+}
+
+//TestCascadeToleratesFuzzedConnections wires FuzzParams/FuzzConn (chunk0-5)
+//into a real cascade: every peer connection fails a fraction of
+//reads/writes with an error, and persistent reconnection (chunk0-2) is expected to work
+//around it rather than wedge the cascade.
+func TestCascadeToleratesFuzzedConnections(t *testing.T) {
+	addrs := freeAddrs(19200, 2)
+	fuzz := FuzzParams{ProbDropRW: 0.2}
+
+	servers := make([]*Server, len(addrs))
+	for i, addr := range addrs {
+		port := 0
+		fmt.Sscanf(addr[len("127.0.0.1:"):], "%d", &port)
+		servers[i] = NewServer(addr, port, i, addrs)
+		servers[i].SetFuzzParams(fuzz)
+		servers[i].SetDialDeadline(5 * time.Second)
+		servers[i].MainLoop()
+	}
+	for _, s := range servers {
+		s.ConnectServers()
+	}
+	defer closeAll(servers)
+
+	s0 := servers[0]
+	for attempt := 0; attempt < 20; attempt++ {
+		var pk []byte
+		if err := s0.call(1, "Server.GetPK", 0, &pk); err == nil {
+			return
+		}
+	}
+	t.Fatal("server 0 never got a successful GetPK through a fuzzed connection in 20 tries")
+}
@@ -0,0 +1,25 @@
+package server
+
+import "encoding/binary"
+
+//xorInto XORs src into dst in place, a machine word at a time where
+//possible (falling back to a byte loop for the final few bytes), rather
+//than lib's whole-slice Xor. GetResponses calls this once per client for
+//each peer's GetResponses2 reply, folding it into that client's response in
+//place of the per-client xorsChan handshake the single-client path uses.
+func xorInto(dst, src []byte) {
+	n := len(dst)
+	if len(src) < n {
+		n = len(src)
+	}
+
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		d := binary.LittleEndian.Uint64(dst[i : i+8])
+		s := binary.LittleEndian.Uint64(src[i : i+8])
+		binary.LittleEndian.PutUint64(dst[i:i+8], d^s)
+	}
+	for ; i < n; i++ {
+		dst[i] ^= src[i]
+	}
+}